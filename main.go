@@ -1,80 +1,390 @@
 package main
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 )
 
 const (
 	socks5Version = 0x05
 	noAuth        = 0x00
+	userPassAuth  = 0x02
+	noAcceptable  = 0xff
 	connectCmd    = 0x01
+	bindCmd       = 0x02
 	udpAssociate  = 0x03
 	ipv4Address   = 0x01
 	domainName    = 0x03
 	ipv6Address   = 0x04
+
+	userPassAuthVersion = 0x01
+	authSuccess         = 0x00
+	authFailure         = 0x01
 )
 
-var udpConn *net.UDPConn
+// Authenticator negotiates a single SOCKS5 authentication method.
+// GetCode returns the method byte (RFC 1928 section 3) this authenticator
+// handles, and Authenticate performs the method's sub-negotiation over the
+// client connection, returning an error if the client fails to authenticate.
+// On success it returns the identity established by the sub-negotiation
+// (e.g. the username), which is recorded on the resulting AuthContext so a
+// RuleSet can make per-user decisions.
+type Authenticator interface {
+	GetCode() byte
+	Authenticate(r io.Reader, w io.Writer) (map[string]string, error)
+}
 
-func main() {
-	port := "1080"
-	if len(os.Args) > 1 {
-		port = os.Args[1]
+// AuthContext records how a client authenticated, so that downstream code
+// (such as a RuleSet) can make decisions based on identity.
+type AuthContext struct {
+	// Method is the negotiated authentication method code.
+	Method byte
+	// Credentials holds method-specific data, e.g. the username for
+	// StaticCredentials.
+	Credentials map[string]string
+}
+
+// StaticCredentials implements Authenticator for username/password
+// authentication (RFC 1929) against a fixed in-memory credential set.
+type StaticCredentials map[string]string
+
+func (s StaticCredentials) GetCode() byte {
+	return userPassAuth
+}
+
+// Authenticate performs the RFC 1929 username/password sub-negotiation:
+// it reads VER, ULEN, UNAME, PLEN, PASSWD, replies [VER, STATUS], and
+// returns an error if the credentials don't match. On success it returns
+// the authenticated username under the "username" key.
+func (s StaticCredentials) Authenticate(r io.Reader, w io.Writer) (map[string]string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("failed to read auth version: %w", err)
+	}
+	if header[0] != userPassAuthVersion {
+		return nil, fmt.Errorf("unsupported auth version: %d", header[0])
 	}
 
-	// Start TCP listener
-	listener, err := net.Listen("tcp", ":"+port)
-	if err != nil {
-		log.Fatalf("Failed to start TCP server: %v", err)
+	uname := make([]byte, header[1])
+	if _, err := io.ReadFull(r, uname); err != nil {
+		return nil, fmt.Errorf("failed to read username: %w", err)
 	}
-	defer listener.Close()
 
-	// Start UDP listener
-	udpAddr, err := net.ResolveUDPAddr("udp", ":"+port)
-	if err != nil {
-		log.Fatalf("Failed to resolve UDP address: %v", err)
+	plenBuf := make([]byte, 1)
+	if _, err := io.ReadFull(r, plenBuf); err != nil {
+		return nil, fmt.Errorf("failed to read password length: %w", err)
+	}
+	passwd := make([]byte, plenBuf[0])
+	if _, err := io.ReadFull(r, passwd); err != nil {
+		return nil, fmt.Errorf("failed to read password: %w", err)
+	}
+
+	want, ok := s[string(uname)]
+	if !ok || want != string(passwd) {
+		w.Write([]byte{userPassAuthVersion, authFailure})
+		return nil, fmt.Errorf("authentication failed for user %q", string(uname))
+	}
+
+	if _, err := w.Write([]byte{userPassAuthVersion, authSuccess}); err != nil {
+		return nil, err
 	}
-	udpConn, err = net.ListenUDP("udp", udpAddr)
+	return map[string]string{"username": string(uname)}, nil
+}
+
+// Dialer dials an outbound TCP connection on the server's behalf. It
+// matches the shape of (*net.Dialer).DialContext so callers can plug in a
+// custom transport (a userspace network stack, an outbound proxy chain, a
+// tsnet-style dialer, etc.) in place of the default net.Dial.
+type Dialer func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// NameResolver resolves a domainName request to an IP, letting callers
+// override name resolution (e.g. to force upstream DNS, or to return the
+// resolved IP into a reply's BND.ADDR).
+type NameResolver interface {
+	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
+}
+
+// DNSResolver is the default NameResolver, backed by net.DefaultResolver.
+type DNSResolver struct{}
+
+func (DNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	addr, err := net.DefaultResolver.LookupIPAddr(ctx, name)
 	if err != nil {
-		log.Fatalf("Failed to start UDP server: %v", err)
+		return ctx, nil, err
+	}
+	if len(addr) == 0 {
+		return ctx, nil, fmt.Errorf("no addresses found for %s", name)
+	}
+	return ctx, addr[0].IP, nil
+}
+
+// Config holds the authenticators, rules, address rewriter and transport
+// hooks a server uses to service connections. Authenticators are tried in
+// the order the client prefers, restricted to the methods registered here.
+type Config struct {
+	AuthMethods []Authenticator
+	Rules       RuleSet
+	Rewriter    AddressRewriter
+	Resolver    NameResolver
+	Dial        Dialer
+	Logger      *log.Logger
+	// BindIP is the local address used when opening the BIND and UDP
+	// ASSOCIATE listener sockets. Nil binds the wildcard address.
+	BindIP net.IP
+
+	// BindTimeout bounds how long a BIND request waits for the expected
+	// peer to connect before replying with a TTL-expired error. Zero uses
+	// defaultBindTimeout.
+	BindTimeout time.Duration
+	// BindPeerPolicy validates the peer that connects to a BIND listener
+	// against the originally requested target. Nil uses
+	// defaultBindPeerPolicy, which requires the peer's IP to match want
+	// unless want is unspecified.
+	BindPeerPolicy func(want *AddrSpec, peer net.Addr) bool
+
+	// UDPIdleTimeout bounds how long an upstream UDP socket opened by a
+	// session is kept around without traffic before it's evicted. Zero
+	// uses defaultUDPIdleTimeout.
+	UDPIdleTimeout time.Duration
+}
+
+// defaultBindTimeout is how long a BIND listener waits for the expected
+// peer to connect when Config.BindTimeout is unset.
+const defaultBindTimeout = 60 * time.Second
+
+// AddrSpec describes a SOCKS5 address, which is either a resolved IP or an
+// unresolved fully-qualified domain name, plus a port.
+type AddrSpec struct {
+	FQDN string
+	IP   net.IP
+	Port int
+}
+
+// String returns "host:port" (bracketed per net.JoinHostPort for IPv6),
+// preferring the resolved IP over the FQDN when both are set (i.e. after a
+// NameResolver has resolved the request).
+func (a *AddrSpec) String() string {
+	if a.IP != nil {
+		return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
 	}
-	defer udpConn.Close()
+	return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
+}
 
-	log.Printf("SOCKS5 proxy server listening on port %s (TCP and UDP)", port)
+// Request describes a single SOCKS5 request, gathered after the handshake
+// and before the target connection is established, so that a RuleSet or
+// AddressRewriter can inspect it.
+type Request struct {
+	Version     byte
+	Command     byte
+	DestAddr    *AddrSpec
+	RemoteAddr  *AddrSpec
+	AuthContext *AuthContext
+}
 
-	// Handle UDP relay in background
-	go handleUDPRelay()
+// RuleSet decides whether a given request is allowed to proceed. It may
+// return a derived context to pass along additional decision state (e.g. a
+// rate limit token) to later stages.
+type RuleSet interface {
+	Allow(ctx context.Context, req *Request) (context.Context, bool)
+}
+
+// PermitAll is a RuleSet that allows every request, matching the server's
+// historical behavior.
+type PermitAll struct{}
+
+func (PermitAll) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return ctx, true
+}
+
+// PermitCommand is a RuleSet that allows or denies requests based solely on
+// their command (CONNECT, BIND, or UDP ASSOCIATE).
+type PermitCommand struct {
+	AllowConnect   bool
+	AllowBind      bool
+	AllowAssociate bool
+}
+
+func (p PermitCommand) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	switch req.Command {
+	case connectCmd:
+		return ctx, p.AllowConnect
+	case bindCmd:
+		return ctx, p.AllowBind
+	case udpAssociate:
+		return ctx, p.AllowAssociate
+	default:
+		return ctx, false
+	}
+}
+
+// CIDRAllowRule is a RuleSet that only allows CONNECT/BIND destinations
+// whose resolved IP falls within one of Networks, optionally restricted to
+// Ports. A request to an unresolved FQDN is denied, since there is no IP to
+// check against the CIDR list.
+type CIDRAllowRule struct {
+	Networks []*net.IPNet
+	Ports    map[int]bool
+}
+
+func (c CIDRAllowRule) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if req.DestAddr.IP == nil {
+		return ctx, false
+	}
+	if len(c.Ports) > 0 && !c.Ports[req.DestAddr.Port] {
+		return ctx, false
+	}
+	for _, n := range c.Networks {
+		if n.Contains(req.DestAddr.IP) {
+			return ctx, true
+		}
+	}
+	return ctx, false
+}
+
+// AddressRewriter can transparently substitute a request's destination
+// address before it is dialed, e.g. to implement DNS-hijack style
+// redirection.
+type AddressRewriter interface {
+	Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec)
+}
+
+// Server is a configured SOCKS5 proxy server. Construct one with New and
+// one or more Options, then call ListenAndServe or Serve.
+type Server struct {
+	config *Config
+}
+
+// Option configures a Server constructed by New.
+type Option func(*Config)
+
+// WithAuthMethods restricts the server to the given authenticators during
+// method negotiation, replacing any previously registered via WithAuthMethods
+// or WithCredentials.
+func WithAuthMethods(methods ...Authenticator) Option {
+	return func(c *Config) { c.AuthMethods = methods }
+}
+
+// WithCredentials registers a StaticCredentials authenticator, enabling
+// RFC 1929 username/password authentication.
+func WithCredentials(creds StaticCredentials) Option {
+	return func(c *Config) { c.AuthMethods = append(c.AuthMethods, creds) }
+}
+
+// WithLogger sets the logger the server uses for connection and session
+// diagnostics. Nil disables logging.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Config) { c.Logger = logger }
+}
+
+// WithDial overrides how the server dials CONNECT targets, in place of the
+// default (&net.Dialer{}).DialContext.
+func WithDial(dial Dialer) Option {
+	return func(c *Config) { c.Dial = dial }
+}
+
+// WithResolver overrides how the server resolves domainName requests, in
+// place of the default DNSResolver.
+func WithResolver(resolver NameResolver) Option {
+	return func(c *Config) { c.Resolver = resolver }
+}
 
+// WithRules overrides the server's RuleSet, in place of the default
+// PermitAll.
+func WithRules(rules RuleSet) Option {
+	return func(c *Config) { c.Rules = rules }
+}
+
+// WithBindIP sets the local address used for BIND and UDP ASSOCIATE
+// listener sockets.
+func WithBindIP(ip net.IP) Option {
+	return func(c *Config) { c.BindIP = ip }
+}
+
+// New constructs a Server with sane defaults (no authentication required,
+// every request allowed, net.Dial for outbound connections, DNS lookups
+// via net.DefaultResolver), applying opts on top.
+func New(opts ...Option) *Server {
+	cfg := &Config{
+		Rules:    PermitAll{},
+		Resolver: DNSResolver{},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+		Logger: log.Default(),
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	return &Server{config: cfg}
+}
+
+// ListenAndServe listens on the given network/address and serves SOCKS5
+// connections until Accept fails.
+func (s *Server) ListenAndServe(network, addr string) error {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Serve accepts connections from l and handles each in its own goroutine
+// until Accept fails, at which point it returns the error.
+func (s *Server) Serve(l net.Listener) error {
+	s.logf("SOCKS5 proxy server listening on %s (each UDP ASSOCIATE opens its own relay socket)", l.Addr())
 	for {
-		conn, err := listener.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
-			continue
+			return err
 		}
+		go s.handleConnection(conn)
+	}
+}
 
-		go handleConnection(conn)
+// logf logs through the server's configured Logger, if any.
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.config.Logger != nil {
+		s.config.Logger.Printf(format, args...)
 	}
 }
 
-func handleConnection(conn net.Conn) {
+func main() {
+	port := "1080"
+	if len(os.Args) > 1 {
+		port = os.Args[1]
+	}
+
+	server := New()
+	if err := server.ListenAndServe("tcp", ":"+port); err != nil {
+		log.Fatalf("SOCKS5 server error: %v", err)
+	}
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
 	// SOCKS5 handshake
-	if err := handshake(conn); err != nil {
-		log.Printf("Handshake failed: %v", err)
+	authCtx, err := s.handshake(conn)
+	if err != nil {
+		s.logf("Handshake failed: %v", err)
 		return
 	}
 
 	// Handle SOCKS5 request
-	targetConn, err := handleRequest(conn)
+	targetConn, err := s.handleRequest(conn, authCtx)
 	if err != nil {
-		log.Printf("Request handling failed: %v", err)
+		s.logf("Request handling failed: %v", err)
 		return
 	}
 	defer targetConn.Close()
@@ -83,32 +393,95 @@ func handleConnection(conn net.Conn) {
 	relay(conn, targetConn)
 }
 
-func handshake(conn net.Conn) error {
+// handshake negotiates the SOCKS5 method (RFC 1928 section 3), picking the
+// strongest method the client offers that is also registered in the
+// server's config, then runs that method's sub-negotiation. It returns the
+// resulting AuthContext.
+func (s *Server) handshake(conn net.Conn) (*AuthContext, error) {
+	cfg := s.config
 	// Read version and number of methods
 	buf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, buf); err != nil {
-		return fmt.Errorf("failed to read handshake: %w", err)
+		return nil, fmt.Errorf("failed to read handshake: %w", err)
 	}
 
 	version := buf[0]
 	nMethods := buf[1]
 
 	if version != socks5Version {
-		return fmt.Errorf("unsupported SOCKS version: %d", version)
+		return nil, fmt.Errorf("unsupported SOCKS version: %d", version)
 	}
 
 	// Read methods
 	methods := make([]byte, nMethods)
 	if _, err := io.ReadFull(conn, methods); err != nil {
-		return fmt.Errorf("failed to read methods: %w", err)
+		return nil, fmt.Errorf("failed to read methods: %w", err)
 	}
 
-	// Send response: version and selected method (no authentication)
-	_, err := conn.Write([]byte{socks5Version, noAuth})
-	return err
+	authenticator := selectAuthenticator(cfg, methods)
+	if authenticator == nil {
+		conn.Write([]byte{socks5Version, noAcceptable})
+		return nil, fmt.Errorf("no acceptable authentication method offered: %v", methods)
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, authenticator.GetCode()}); err != nil {
+		return nil, fmt.Errorf("failed to write method selection: %w", err)
+	}
+
+	if authenticator.GetCode() == noAuth {
+		return &AuthContext{Method: noAuth}, nil
+	}
+
+	creds, err := authenticator.Authenticate(conn, conn)
+	if err != nil {
+		return nil, fmt.Errorf("authentication failed: %w", err)
+	}
+
+	return &AuthContext{Method: authenticator.GetCode(), Credentials: creds}, nil
+}
+
+// selectAuthenticator picks the authenticator registered in cfg whose code
+// matches one of the client's offered methods, preferring the strongest
+// (highest-value) method available. It falls back to an implicit no-auth
+// authenticator when cfg has none configured, matching legacy behavior.
+func selectAuthenticator(cfg *Config, offered []byte) Authenticator {
+	if len(cfg.AuthMethods) == 0 {
+		for _, m := range offered {
+			if m == noAuth {
+				return noAuthAuthenticator{}
+			}
+		}
+		return nil
+	}
+
+	byCode := make(map[byte]Authenticator, len(cfg.AuthMethods))
+	for _, a := range cfg.AuthMethods {
+		byCode[a.GetCode()] = a
+	}
+
+	var best Authenticator
+	for _, m := range offered {
+		if a, ok := byCode[m]; ok {
+			if best == nil || m > best.GetCode() {
+				best = a
+			}
+		}
+	}
+	return best
 }
 
-func handleRequest(conn net.Conn) (net.Conn, error) {
+// noAuthAuthenticator implements Authenticator for method 0x00, used when a
+// server has no authenticators configured.
+type noAuthAuthenticator struct{}
+
+func (noAuthAuthenticator) GetCode() byte { return noAuth }
+func (noAuthAuthenticator) Authenticate(io.Reader, io.Writer) (map[string]string, error) {
+	return nil, nil
+}
+
+func (s *Server) handleRequest(conn net.Conn, authCtx *AuthContext) (net.Conn, error) {
+	cfg := s.config
+
 	// Read request header
 	buf := make([]byte, 4)
 	if _, err := io.ReadFull(conn, buf); err != nil {
@@ -124,27 +497,91 @@ func handleRequest(conn net.Conn) (net.Conn, error) {
 		return nil, fmt.Errorf("unsupported SOCKS version: %d", version)
 	}
 
-	// Handle different commands
 	switch cmd {
-	case connectCmd:
-		// Continue with TCP CONNECT
-	case udpAssociate:
-		// Handle UDP ASSOCIATE
-		return handleUDPAssociate(conn, addrType)
+	case connectCmd, bindCmd, udpAssociate:
+		// Supported commands; further gated by the ruleset below.
 	default:
-		sendReply(conn, 0x07) // Command not supported
+		sendReply(conn, 0x07, nil) // Command not supported
 		return nil, fmt.Errorf("unsupported command: %d", cmd)
 	}
 
-	// Parse target address
-	var targetAddr string
+	destAddr, err := readAddrSpec(conn, addrType)
+	if err != nil {
+		sendReply(conn, 0x08, nil) // Address type not supported
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if destAddr.FQDN != "" {
+		var ip net.IP
+		ctx, ip, err = cfg.Resolver.Resolve(ctx, destAddr.FQDN)
+		if err != nil {
+			sendReply(conn, replyCodeForError(err), nil)
+			return nil, fmt.Errorf("failed to resolve %s: %w", destAddr.FQDN, err)
+		}
+		destAddr.IP = ip
+	}
+
+	req := &Request{
+		Version:     version,
+		Command:     cmd,
+		DestAddr:    destAddr,
+		RemoteAddr:  addrSpecFromNetAddr(conn.RemoteAddr()),
+		AuthContext: authCtx,
+	}
+
+	if cfg.Rules != nil {
+		var allowed bool
+		ctx, allowed = cfg.Rules.Allow(ctx, req)
+		if !allowed {
+			sendReply(conn, 0x02, nil) // Ruleset rejected the connection
+			return nil, fmt.Errorf("ruleset rejected command %d to %s", cmd, destAddr)
+		}
+	}
+
+	if cfg.Rewriter != nil {
+		ctx, destAddr = cfg.Rewriter.Rewrite(ctx, req)
+	}
+
+	switch cmd {
+	case udpAssociate:
+		return s.handleUDPAssociate(conn, destAddr)
+	case bindCmd:
+		return s.handleBind(conn, destAddr)
+	}
+
+	// Connect to target
+	target := destAddr.String()
+	targetConn, err := cfg.Dial(ctx, "tcp", target)
+	if err != nil {
+		sendReply(conn, replyCodeForError(err), nil)
+		return nil, fmt.Errorf("failed to connect to target %s: %w", target, err)
+	}
+
+	// Send success reply, reporting the outbound socket's local address
+	// as BND.ADDR/BND.PORT so clients that rely on it (e.g. curl) see
+	// where traffic is actually originating from.
+	if err := sendReply(conn, 0x00, targetConn.LocalAddr()); err != nil {
+		targetConn.Close()
+		return nil, err
+	}
+
+	s.logf("Connected to %s", target)
+	return targetConn, nil
+}
+
+// readAddrSpec reads a DST.ADDR/DST.PORT pair (ATYP already consumed) from
+// conn and resolves it into an AddrSpec, leaving FQDN requests unresolved.
+func readAddrSpec(conn net.Conn, addrType byte) (*AddrSpec, error) {
+	spec := &AddrSpec{}
+
 	switch addrType {
 	case ipv4Address:
 		addr := make([]byte, 4)
 		if _, err := io.ReadFull(conn, addr); err != nil {
 			return nil, fmt.Errorf("failed to read IPv4 address: %w", err)
 		}
-		targetAddr = net.IP(addr).String()
+		spec.IP = net.IP(addr)
 
 	case domainName:
 		lenBuf := make([]byte, 1)
@@ -155,59 +592,96 @@ func handleRequest(conn net.Conn) (net.Conn, error) {
 		if _, err := io.ReadFull(conn, domain); err != nil {
 			return nil, fmt.Errorf("failed to read domain: %w", err)
 		}
-		targetAddr = string(domain)
+		spec.FQDN = string(domain)
 
 	case ipv6Address:
 		addr := make([]byte, 16)
 		if _, err := io.ReadFull(conn, addr); err != nil {
 			return nil, fmt.Errorf("failed to read IPv6 address: %w", err)
 		}
-		targetAddr = net.IP(addr).String()
+		spec.IP = net.IP(addr)
 
 	default:
-		sendReply(conn, 0x08) // Address type not supported
 		return nil, fmt.Errorf("unsupported address type: %d", addrType)
 	}
 
-	// Read port
 	portBuf := make([]byte, 2)
 	if _, err := io.ReadFull(conn, portBuf); err != nil {
 		return nil, fmt.Errorf("failed to read port: %w", err)
 	}
-	port := binary.BigEndian.Uint16(portBuf)
+	spec.Port = int(binary.BigEndian.Uint16(portBuf))
 
-	// Connect to target
-	target := fmt.Sprintf("%s:%d", targetAddr, port)
-	targetConn, err := net.Dial("tcp", target)
+	return spec, nil
+}
+
+// addrSpecFromNetAddr converts a net.Addr (as returned by conn.RemoteAddr)
+// into an AddrSpec for use in a Request.
+func addrSpecFromNetAddr(addr net.Addr) *AddrSpec {
+	host, portStr, err := net.SplitHostPort(addr.String())
 	if err != nil {
-		sendReply(conn, 0x05) // Connection refused
-		return nil, fmt.Errorf("failed to connect to target %s: %w", target, err)
+		return &AddrSpec{}
 	}
+	port, _ := strconv.Atoi(portStr)
+	return &AddrSpec{IP: net.ParseIP(host), Port: port}
+}
 
-	// Send success reply
-	if err := sendReply(conn, 0x00); err != nil {
-		targetConn.Close()
-		return nil, err
+// sendReply writes a SOCKS5 reply (RFC 1928 section 6), encoding addr's IP
+// and port as BND.ADDR/BND.PORT with the matching ATYP. addr may be nil
+// (e.g. for error replies sent before a target connection exists), in
+// which case the reply carries the zero address 0.0.0.0:0.
+func sendReply(conn net.Conn, rep byte, addr net.Addr) error {
+	atyp := byte(ipv4Address)
+	ip := net.IPv4zero
+	port := 0
+
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+		port = a.Port
+	case *net.UDPAddr:
+		ip = a.IP
+		port = a.Port
 	}
 
-	log.Printf("Connected to %s", target)
-	return targetConn, nil
-}
-
-func sendReply(conn net.Conn, rep byte) error {
-	// Reply format: VER REP RSV ATYP BND.ADDR BND.PORT
-	reply := []byte{
-		socks5Version,
-		rep,
-		0x00,       // Reserved
-		0x01,       // IPv4
-		0, 0, 0, 0, // Bind address (0.0.0.0)
-		0, 0, // Bind port (0)
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	} else {
+		atyp = ipv6Address
+		ip = ip.To16()
 	}
+
+	reply := []byte{socks5Version, rep, 0x00, atyp}
+	reply = append(reply, ip...)
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	reply = append(reply, portBytes...)
+
 	_, err := conn.Write(reply)
 	return err
 }
 
+// replyCodeForError maps an error encountered while resolving or dialing a
+// CONNECT target to the appropriate RFC 1928 reply code.
+func replyCodeForError(err error) byte {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 0x06 // TTL expired
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return 0x05 // Connection refused
+	}
+	if errors.Is(err, syscall.EHOSTUNREACH) {
+		return 0x04 // Host unreachable
+	}
+	if errors.Is(err, syscall.ENETUNREACH) {
+		return 0x03 // Network unreachable
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return 0x04 // Host unreachable
+	}
+	return 0x01 // General SOCKS server failure
+}
+
 func relay(client, target net.Conn) {
 	done := make(chan struct{}, 2)
 
@@ -227,91 +701,228 @@ func relay(client, target net.Conn) {
 	<-done
 }
 
-func handleUDPAssociate(conn net.Conn, addrType byte) (net.Conn, error) {
-	// Read and discard the destination address and port from the request
-	// For UDP ASSOCIATE, client sends desired address (usually 0.0.0.0:0)
-	switch addrType {
-	case ipv4Address:
-		io.ReadFull(conn, make([]byte, 4))
-	case domainName:
-		lenBuf := make([]byte, 1)
-		io.ReadFull(conn, lenBuf)
-		io.ReadFull(conn, make([]byte, lenBuf[0]))
-	case ipv6Address:
-		io.ReadFull(conn, make([]byte, 16))
+// handleBind implements the SOCKS5 BIND command (RFC 1928 section 4),
+// primarily used by FTP-style protocols where the server opens a reverse
+// connection back to the client. It opens a listener, replies once with
+// the bound address, waits for exactly one peer to connect, replies again
+// with the peer's address, and returns that connection for relaying.
+func (s *Server) handleBind(conn net.Conn, destAddr *AddrSpec) (net.Conn, error) {
+	cfg := s.config
+
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: cfg.BindIP})
+	if err != nil {
+		sendReply(conn, 0x01, nil) // General SOCKS server failure
+		return nil, fmt.Errorf("failed to open BIND listener: %w", err)
+	}
+
+	bindAddr := listener.Addr().(*net.TCPAddr)
+	if err := sendBindReply(conn, 0x00, bindAddr); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to send BIND first reply: %w", err)
+	}
+
+	timeout := cfg.BindTimeout
+	if timeout <= 0 {
+		timeout = defaultBindTimeout
 	}
-	io.ReadFull(conn, make([]byte, 2)) // port
+	listener.SetDeadline(time.Now().Add(timeout))
 
-	// Get the UDP relay address
-	udpAddr := udpConn.LocalAddr().(*net.UDPAddr)
+	peerConn, err := listener.Accept()
+	listener.Close()
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			sendReply(conn, 0x06, nil) // TTL expired
+			return nil, fmt.Errorf("BIND accept timed out: %w", err)
+		}
+		sendReply(conn, 0x04, nil) // Host unreachable
+		return nil, fmt.Errorf("BIND accept failed: %w", err)
+	}
 
-	// Send reply with UDP relay address and port
-	reply := []byte{
-		socks5Version,
-		0x00, // Success
-		0x00, // Reserved
-		0x01, // IPv4
+	policy := cfg.BindPeerPolicy
+	if policy == nil {
+		policy = defaultBindPeerPolicy
+	}
+	if !policy(destAddr, peerConn.RemoteAddr()) {
+		peerConn.Close()
+		sendReply(conn, 0x04, nil) // Host unreachable
+		return nil, fmt.Errorf("BIND peer %s did not match requested target %s", peerConn.RemoteAddr(), destAddr)
+	}
+
+	peerAddr, err := net.ResolveTCPAddr("tcp", peerConn.RemoteAddr().String())
+	if err != nil {
+		peerConn.Close()
+		sendReply(conn, 0x01, nil) // General SOCKS server failure
+		return nil, fmt.Errorf("failed to resolve BIND peer address: %w", err)
+	}
+	if err := sendBindReply(conn, 0x00, peerAddr); err != nil {
+		peerConn.Close()
+		return nil, fmt.Errorf("failed to send BIND second reply: %w", err)
 	}
-	// Add bind address (0.0.0.0 for simplicity)
-	reply = append(reply, 0, 0, 0, 0)
-	// Add bind port
+
+	s.logf("BIND accepted connection from %s", peerConn.RemoteAddr())
+	return peerConn, nil
+}
+
+// defaultBindPeerPolicy requires the BIND peer's IP to match want, unless
+// want has no IP or is unspecified (0.0.0.0/::), in which case any peer is
+// accepted.
+func defaultBindPeerPolicy(want *AddrSpec, peer net.Addr) bool {
+	if want == nil || want.IP == nil || want.IP.IsUnspecified() {
+		return true
+	}
+	host, _, err := net.SplitHostPort(peer.String())
+	if err != nil {
+		return false
+	}
+	peerIP := net.ParseIP(host)
+	return peerIP != nil && peerIP.Equal(want.IP)
+}
+
+// sendBindReply writes a SOCKS5 reply carrying addr's IP and port as
+// BND.ADDR/BND.PORT, choosing ATYP based on whether addr.IP is IPv4 or
+// IPv6.
+func sendBindReply(conn net.Conn, rep byte, addr *net.TCPAddr) error {
+	atyp := byte(ipv4Address)
+	ip := addr.IP.To4()
+	if ip == nil {
+		atyp = ipv6Address
+		ip = addr.IP.To16()
+	}
+
+	reply := []byte{socks5Version, rep, 0x00, atyp}
+	reply = append(reply, ip...)
 	portBytes := make([]byte, 2)
-	binary.BigEndian.PutUint16(portBytes, uint16(udpAddr.Port))
+	binary.BigEndian.PutUint16(portBytes, uint16(addr.Port))
 	reply = append(reply, portBytes...)
 
-	if _, err := conn.Write(reply); err != nil {
-		return nil, fmt.Errorf("failed to send UDP ASSOCIATE reply: %w", err)
-	}
+	_, err := conn.Write(reply)
+	return err
+}
 
-	log.Printf("UDP ASSOCIATE established, relay port: %d", udpAddr.Port)
+// defaultUDPIdleTimeout is how long an upstream UDP socket within a
+// session is kept open without traffic before it is evicted, when
+// Config.UDPIdleTimeout is unset.
+const defaultUDPIdleTimeout = 2 * time.Minute
+
+// udpUpstream is a relay socket dialed to a single target on behalf of a
+// UDP session, kept open across round-trips so replies keep flowing back
+// through the same socket.
+type udpUpstream struct {
+	conn     *net.UDPConn
+	lastUsed time.Time
+}
 
-	// Keep the TCP connection alive for the UDP association
-	// Return a dummy connection that will be closed when client disconnects
-	return &dummyConn{conn}, nil
+// udpSession is the state for one client's UDP ASSOCIATE: its own relay
+// socket, the client address learned from the first datagram, and the set
+// of upstream sockets opened for targets the client has sent to.
+type udpSession struct {
+	relayConn   *net.UDPConn
+	clientIP    net.IP // expected source IP, learned from the TCP control connection
+	idleTimeout time.Duration
+	logger      *log.Logger
+
+	mu         sync.Mutex
+	clientAddr *net.UDPAddr // locked to the first datagram's source address
+	upstreams  map[string]*udpUpstream
+
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
-type dummyConn struct {
-	net.Conn
+func newUDPSession(clientIP net.IP, idleTimeout time.Duration, bindIP net.IP, logger *log.Logger) (*udpSession, error) {
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		return nil, err
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	s := &udpSession{
+		relayConn:   relayConn,
+		clientIP:    clientIP,
+		idleTimeout: idleTimeout,
+		logger:      logger,
+		upstreams:   make(map[string]*udpUpstream),
+		closed:      make(chan struct{}),
+	}
+	go s.relayLoop()
+	go s.evictIdleUpstreams()
+	return s, nil
 }
 
-func (d *dummyConn) Read(b []byte) (n int, err error) {
-	// Block until client closes connection
-	return d.Conn.Read(b)
+// logf logs through the session's configured logger, if any.
+func (s *udpSession) logf(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
+	}
 }
 
-func (d *dummyConn) Write(b []byte) (n int, err error) {
-	return 0, nil // No-op
+// Close tears down the session's relay socket and every upstream socket
+// it opened. It is safe to call multiple times.
+func (s *udpSession) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.relayConn.Close()
+		s.mu.Lock()
+		for key, u := range s.upstreams {
+			u.conn.Close()
+			delete(s.upstreams, key)
+		}
+		s.mu.Unlock()
+	})
 }
 
-func handleUDPRelay() {
+// relayLoop reads datagrams the client sends to the session's relay
+// socket and forwards each to its target, opening or reusing a
+// per-target upstream socket. Each datagram is handled in its own
+// goroutine so a slow resolve or dial for one target can't stall
+// delivery of datagrams to other targets.
+func (s *udpSession) relayLoop() {
 	buffer := make([]byte, 65535)
 	for {
-		n, clientAddr, err := udpConn.ReadFromUDP(buffer)
+		n, from, err := s.relayConn.ReadFromUDP(buffer)
 		if err != nil {
-			log.Printf("UDP read error: %v", err)
+			return // relayConn was closed
+		}
+
+		s.mu.Lock()
+		if s.clientAddr == nil {
+			if !s.clientIP.Equal(from.IP) {
+				s.mu.Unlock()
+				s.logf("UDP session: dropping first datagram from %s, expected source IP %s", from, s.clientIP)
+				continue
+			}
+			s.clientAddr = from
+		}
+		locked := s.clientAddr
+		s.mu.Unlock()
+
+		if !locked.IP.Equal(from.IP) || locked.Port != from.Port {
+			s.logf("UDP session: dropping datagram from unexpected source %s (locked to %s)", from, locked)
 			continue
 		}
 
-		go processUDPPacket(buffer[:n], clientAddr)
+		go s.handleClientPacket(append([]byte(nil), buffer[:n]...))
 	}
 }
 
-func processUDPPacket(data []byte, clientAddr *net.UDPAddr) {
-	// Parse SOCKS5 UDP request header
+// handleClientPacket parses one client->target datagram (RFC 1928 section
+// 7) and forwards its payload to the target over a per-target upstream
+// socket, spawning a reader goroutine for that socket the first time it's
+// used.
+func (s *udpSession) handleClientPacket(data []byte) {
 	if len(data) < 10 {
-		log.Printf("UDP packet too short: %d bytes", len(data))
+		s.logf("UDP packet too short: %d bytes", len(data))
 		return
 	}
 
-	// RSV (2 bytes) + FRAG (1 byte)
 	if data[0] != 0 || data[1] != 0 {
-		log.Printf("Invalid RSV field")
+		s.logf("Invalid RSV field")
 		return
 	}
 
-	frag := data[2]
-	if frag != 0 {
-		log.Printf("Fragmentation not supported")
+	if frag := data[2]; frag != 0 {
+		s.logf("Dropping fragmented UDP datagram (FRAG=%d), fragmentation not supported", frag)
 		return
 	}
 
@@ -346,61 +957,164 @@ func processUDPPacket(data []byte, clientAddr *net.UDPAddr) {
 		headerLen = 22
 
 	default:
-		log.Printf("Unsupported address type: %d", addrType)
+		s.logf("Unsupported address type: %d", addrType)
 		return
 	}
 
-	// Extract port
 	portOffset := headerLen - 2
 	targetPort := binary.BigEndian.Uint16(data[portOffset : portOffset+2])
-
-	// Extract payload
 	payload := data[headerLen:]
 
 	target := fmt.Sprintf("%s:%d", targetAddr, targetPort)
-
-	// Forward to destination
-	destAddr, err := net.ResolveUDPAddr("udp", target)
+	targetUDPAddr, err := net.ResolveUDPAddr("udp", target)
 	if err != nil {
-		log.Printf("Failed to resolve target %s: %v", target, err)
+		s.logf("Failed to resolve target %s: %v", target, err)
 		return
 	}
 
-	// Create a temporary UDP connection for this request
-	tempConn, err := net.DialUDP("udp", nil, destAddr)
+	upstream, err := s.getOrDialUpstream(target, targetUDPAddr, targetAddr, targetPort, addrType)
 	if err != nil {
-		log.Printf("Failed to dial target %s: %v", target, err)
+		s.logf("Failed to dial target %s: %v", target, err)
 		return
 	}
-	defer tempConn.Close()
 
-	// Send payload to target
-	if _, err := tempConn.Write(payload); err != nil {
-		log.Printf("Failed to send to target %s: %v", target, err)
+	if _, err := upstream.conn.Write(payload); err != nil {
+		s.logf("Failed to send to target %s: %v", target, err)
 		return
 	}
 
-	log.Printf("UDP relay: %s -> %s (%d bytes)", clientAddr, target, len(payload))
+	s.logf("UDP relay: %s -> %s (%d bytes)", s.relayConn.LocalAddr(), target, len(payload))
+}
 
-	// Wait for reply from target
-	tempConn.SetReadDeadline(time.Now().Add(5 * time.Second))
-	replyBuf := make([]byte, 65535)
-	n, err := tempConn.Read(replyBuf)
+// getOrDialUpstream returns the existing upstream socket for target, or
+// dials a new one and starts a goroutine relaying its replies back to the
+// locked client address.
+func (s *udpSession) getOrDialUpstream(key string, targetUDPAddr *net.UDPAddr, targetAddr string, targetPort uint16, addrType byte) (*udpUpstream, error) {
+	s.mu.Lock()
+	if u, ok := s.upstreams[key]; ok {
+		u.lastUsed = time.Now()
+		s.mu.Unlock()
+		return u, nil
+	}
+	s.mu.Unlock()
+
+	conn, err := net.DialUDP("udp", nil, targetUDPAddr)
 	if err != nil {
-		// Timeout or error - this is normal for UDP
-		return
+		return nil, err
 	}
+	u := &udpUpstream{conn: conn, lastUsed: time.Now()}
 
-	// Build SOCKS5 UDP reply header
-	reply := buildUDPReply(targetAddr, targetPort, addrType, replyBuf[:n])
+	s.mu.Lock()
+	s.upstreams[key] = u
+	s.mu.Unlock()
 
-	// Send reply back to client
-	if _, err := udpConn.WriteToUDP(reply, clientAddr); err != nil {
-		log.Printf("Failed to send reply to client: %v", err)
-		return
+	go s.relayUpstreamReplies(key, u, targetAddr, targetPort, addrType)
+	return u, nil
+}
+
+// relayUpstreamReplies reads every reply the upstream socket receives and
+// forwards it back to the client through the session's relay socket,
+// until the upstream is closed (by idle eviction or session teardown).
+func (s *udpSession) relayUpstreamReplies(key string, u *udpUpstream, targetAddr string, targetPort uint16, addrType byte) {
+	buffer := make([]byte, 65535)
+	for {
+		n, err := u.conn.Read(buffer)
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		u.lastUsed = time.Now()
+		clientAddr := s.clientAddr
+		s.mu.Unlock()
+		if clientAddr == nil {
+			continue
+		}
+
+		reply := buildUDPReply(targetAddr, targetPort, addrType, buffer[:n])
+		if _, err := s.relayConn.WriteToUDP(reply, clientAddr); err != nil {
+			s.logf("Failed to send UDP reply to client: %v", err)
+			return
+		}
+
+		s.logf("UDP reply: %s <- %s (%d bytes)", clientAddr, key, n)
+	}
+}
+
+// evictIdleUpstreams periodically closes and forgets upstream sockets
+// that have seen no traffic for longer than the session's idle timeout.
+func (s *udpSession) evictIdleUpstreams() {
+	ticker := time.NewTicker(s.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			for key, u := range s.upstreams {
+				if time.Since(u.lastUsed) > s.idleTimeout {
+					u.conn.Close()
+					delete(s.upstreams, key)
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Server) handleUDPAssociate(conn net.Conn, destAddr *AddrSpec) (net.Conn, error) {
+	cfg := s.config
+
+	// destAddr carries the client's desired address (usually 0.0.0.0:0),
+	// already consumed from the request by readAddrSpec.
+	_ = destAddr
+
+	clientIP := net.IPv4zero
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			clientIP = ip
+		}
+	}
+
+	session, err := newUDPSession(clientIP, cfg.UDPIdleTimeout, cfg.BindIP, cfg.Logger)
+	if err != nil {
+		sendReply(conn, 0x01, nil) // General SOCKS server failure
+		return nil, fmt.Errorf("failed to open UDP relay socket: %w", err)
 	}
 
-	log.Printf("UDP reply: %s <- %s (%d bytes)", clientAddr, target, n)
+	relayAddr := session.relayConn.LocalAddr().(*net.UDPAddr)
+	if err := sendReply(conn, 0x00, relayAddr); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("failed to send UDP ASSOCIATE reply: %w", err)
+	}
+
+	s.logf("UDP ASSOCIATE established, relay port: %d", relayAddr.Port)
+
+	// Keep the TCP control connection alive for the lifetime of the UDP
+	// association; tearing it down closes the relay and every upstream
+	// socket the session opened.
+	return &dummyConn{Conn: conn, onClose: session.Close}, nil
+}
+
+type dummyConn struct {
+	net.Conn
+	onClose func()
+}
+
+func (d *dummyConn) Read(b []byte) (n int, err error) {
+	// Block until the client closes the TCP control connection, then tear
+	// down the associated UDP session.
+	n, err = d.Conn.Read(b)
+	if err != nil {
+		d.onClose()
+	}
+	return n, err
+}
+
+func (d *dummyConn) Write(b []byte) (n int, err error) {
+	return 0, nil // No-op
 }
 
 func buildUDPReply(targetAddr string, targetPort uint16, addrType byte, payload []byte) []byte {
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStaticCredentialsAuthenticate(t *testing.T) {
+	creds := StaticCredentials{"alice": "hunter2"}
+
+	tests := []struct {
+		name     string
+		uname    string
+		passwd   string
+		wantErr  bool
+		wantUser string
+	}{
+		{name: "valid credentials", uname: "alice", passwd: "hunter2", wantUser: "alice"},
+		{name: "wrong password", uname: "alice", passwd: "wrong", wantErr: true},
+		{name: "unknown user", uname: "bob", passwd: "hunter2", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req bytes.Buffer
+			req.WriteByte(userPassAuthVersion)
+			req.WriteByte(byte(len(tt.uname)))
+			req.WriteString(tt.uname)
+			req.WriteByte(byte(len(tt.passwd)))
+			req.WriteString(tt.passwd)
+
+			var resp bytes.Buffer
+			identity, err := creds.Authenticate(&req, &resp)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Authenticate() error = nil, want error")
+				}
+				if got := resp.Bytes(); !bytes.Equal(got, []byte{userPassAuthVersion, authFailure}) {
+					t.Errorf("reply = %v, want failure reply", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Authenticate() error = %v, want nil", err)
+			}
+			if got := resp.Bytes(); !bytes.Equal(got, []byte{userPassAuthVersion, authSuccess}) {
+				t.Errorf("reply = %v, want success reply", got)
+			}
+			if identity["username"] != tt.wantUser {
+				t.Errorf("identity[username] = %q, want %q", identity["username"], tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestPermitCommand(t *testing.T) {
+	rules := PermitCommand{AllowConnect: true, AllowBind: false, AllowAssociate: true}
+
+	tests := []struct {
+		cmd  byte
+		want bool
+	}{
+		{connectCmd, true},
+		{bindCmd, false},
+		{udpAssociate, true},
+	}
+
+	for _, tt := range tests {
+		_, got := rules.Allow(context.Background(), &Request{Command: tt.cmd})
+		if got != tt.want {
+			t.Errorf("Allow(cmd=%#x) = %v, want %v", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestCIDRAllowRule(t *testing.T) {
+	_, allowed, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatalf("ParseCIDR: %v", err)
+	}
+	rule := CIDRAllowRule{
+		Networks: []*net.IPNet{allowed},
+		Ports:    map[int]bool{443: true},
+	}
+
+	tests := []struct {
+		name string
+		addr *AddrSpec
+		want bool
+	}{
+		{name: "allowed network and port", addr: &AddrSpec{IP: net.ParseIP("10.1.2.3"), Port: 443}, want: true},
+		{name: "allowed network, wrong port", addr: &AddrSpec{IP: net.ParseIP("10.1.2.3"), Port: 80}, want: false},
+		{name: "disallowed network", addr: &AddrSpec{IP: net.ParseIP("192.168.1.1"), Port: 443}, want: false},
+		{name: "unresolved FQDN is denied", addr: &AddrSpec{FQDN: "example.com", Port: 443}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got := rule.Allow(context.Background(), &Request{DestAddr: tt.addr})
+			if got != tt.want {
+				t.Errorf("Allow() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplyCodeForError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want byte
+	}{
+		{name: "connection refused", err: syscall.ECONNREFUSED, want: 0x05},
+		{name: "host unreachable", err: syscall.EHOSTUNREACH, want: 0x04},
+		{name: "network unreachable", err: syscall.ENETUNREACH, want: 0x03},
+		{name: "deadline exceeded", err: context.DeadlineExceeded, want: 0x06},
+		{name: "dns error", err: &net.DNSError{Err: "no such host", Name: "example.invalid"}, want: 0x04},
+		{name: "unknown error", err: errors.New("boom"), want: 0x01},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replyCodeForError(tt.err); got != tt.want {
+				t.Errorf("replyCodeForError(%v) = %#x, want %#x", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDefaults(t *testing.T) {
+	srv := New()
+
+	if _, ok := srv.config.Rules.(PermitAll); !ok {
+		t.Errorf("default Rules = %T, want PermitAll", srv.config.Rules)
+	}
+	if _, ok := srv.config.Resolver.(DNSResolver); !ok {
+		t.Errorf("default Resolver = %T, want DNSResolver", srv.config.Resolver)
+	}
+	if srv.config.Dial == nil {
+		t.Error("default Dial is nil")
+	}
+}
+
+func TestOptionsOverrideDefaults(t *testing.T) {
+	rules := PermitCommand{AllowConnect: true}
+	bindIP := net.ParseIP("127.0.0.1")
+
+	srv := New(WithRules(rules), WithBindIP(bindIP))
+
+	if got, ok := srv.config.Rules.(PermitCommand); !ok || got != rules {
+		t.Errorf("Rules = %#v, want %#v", srv.config.Rules, rules)
+	}
+	if !srv.config.BindIP.Equal(bindIP) {
+		t.Errorf("BindIP = %v, want %v", srv.config.BindIP, bindIP)
+	}
+}
+
+// readReply reads one SOCKS5 reply ([VER, REP, RSV, ATYP, ADDR..., PORT(2)])
+// off r, sized according to its ATYP.
+func readReply(t *testing.T, r net.Conn) []byte {
+	t.Helper()
+	header := make([]byte, 4)
+	if _, err := readFull(r, header); err != nil {
+		t.Fatalf("read reply header: %v", err)
+	}
+
+	var addrLen int
+	switch header[3] {
+	case ipv4Address:
+		addrLen = 4
+	case ipv6Address:
+		addrLen = 16
+	default:
+		t.Fatalf("unexpected ATYP in reply: %d", header[3])
+	}
+
+	rest := make([]byte, addrLen+2)
+	if _, err := readFull(r, rest); err != nil {
+		t.Fatalf("read reply body: %v", err)
+	}
+	return append(header, rest...)
+}
+
+func readFull(r net.Conn, buf []byte) (int, error) {
+	total := 0
+	for total < len(buf) {
+		n, err := r.Read(buf[total:])
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+func TestHandleBindAcceptTimeout(t *testing.T) {
+	srv := New(WithBindIP(net.ParseIP("127.0.0.1")))
+	srv.config.BindTimeout = 50 * time.Millisecond
+
+	client, serverSide := net.Pipe()
+	defer client.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := srv.handleBind(serverSide, &AddrSpec{IP: net.ParseIP("127.0.0.1"), Port: 0})
+		errCh <- err
+	}()
+
+	first := readReply(t, client)
+	if first[1] != 0x00 {
+		t.Fatalf("first reply REP = %#x, want 0x00", first[1])
+	}
+
+	second := readReply(t, client)
+	if second[1] != 0x06 {
+		t.Errorf("second reply REP = %#x, want 0x06 (TTL expired)", second[1])
+	}
+
+	if err := <-errCh; err == nil {
+		t.Error("handleBind() error = nil, want accept-timeout error")
+	}
+}
+
+func TestHandleBindPeerMismatch(t *testing.T) {
+	srv := New(WithBindIP(net.ParseIP("127.0.0.1")))
+
+	client, serverSide := net.Pipe()
+	defer client.Close()
+
+	// Requesting a target that can never match a loopback peer forces
+	// defaultBindPeerPolicy to reject whoever connects.
+	want := &AddrSpec{IP: net.ParseIP("10.1.2.3"), Port: 0}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := srv.handleBind(serverSide, want)
+		errCh <- err
+	}()
+
+	first := readReply(t, client)
+	bindPort := binary.BigEndian.Uint16(first[len(first)-2:])
+
+	peerConn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", bindPort))
+	if err != nil {
+		t.Fatalf("dial BIND listener: %v", err)
+	}
+	defer peerConn.Close()
+
+	second := readReply(t, client)
+	if second[1] != 0x04 {
+		t.Errorf("second reply REP = %#x, want 0x04 (host unreachable)", second[1])
+	}
+
+	if err := <-errCh; err == nil {
+		t.Error("handleBind() error = nil, want peer-mismatch error")
+	}
+}
+
+// newUDPEcho starts a UDP listener on loopback that echoes every datagram
+// it receives back to its sender, for use as a UDP ASSOCIATE target.
+func newUDPEcho(t *testing.T) (*net.UDPAddr, func()) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("newUDPEcho: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr), func() { conn.Close() }
+}
+
+// buildClientUDPPacket wraps payload in an RFC 1928 section 7 UDP request
+// header addressed to target (assumed IPv4).
+func buildClientUDPPacket(target *net.UDPAddr, payload []byte) []byte {
+	packet := []byte{0, 0, 0, ipv4Address}
+	packet = append(packet, target.IP.To4()...)
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(target.Port))
+	packet = append(packet, portBytes...)
+	return append(packet, payload...)
+}
+
+func TestUDPSessionReusesUpstreamForSameTarget(t *testing.T) {
+	echoAddr, stopEcho := newUDPEcho(t)
+	defer stopEcho()
+
+	session, err := newUDPSession(net.ParseIP("127.0.0.1"), time.Minute, net.ParseIP("127.0.0.1"), nil)
+	if err != nil {
+		t.Fatalf("newUDPSession: %v", err)
+	}
+	defer session.Close()
+
+	clientConn, err := net.DialUDP("udp", nil, session.relayConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("dial relay socket: %v", err)
+	}
+	defer clientConn.Close()
+
+	send := func(payload []byte) []byte {
+		packet := buildClientUDPPacket(echoAddr, payload)
+		if _, err := clientConn.Write(packet); err != nil {
+			t.Fatalf("write client datagram: %v", err)
+		}
+		clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 65535)
+		n, err := clientConn.Read(buf)
+		if err != nil {
+			t.Fatalf("read relay reply: %v", err)
+		}
+		return buf[:n]
+	}
+
+	for i, payload := range [][]byte{[]byte("round-trip-1"), []byte("round-trip-2")} {
+		reply := send(payload)
+		// Reply header is RSV(2)+FRAG(1)+ATYP(1)+ADDR(4)+PORT(2) for IPv4.
+		if got := string(reply[10:]); got != string(payload) {
+			t.Errorf("round-trip %d payload = %q, want %q", i, got, payload)
+		}
+	}
+
+	session.mu.Lock()
+	n := len(session.upstreams)
+	session.mu.Unlock()
+	if n != 1 {
+		t.Errorf("upstreams after two datagrams to the same target = %d, want 1 (same socket reused)", n)
+	}
+}